@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseChildSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    childSpec
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			spec: "web=perl,server.pl",
+			want: childSpec{Name: "web", Cmd: "perl", Args: []string{"server.pl"}, Restart: "on-failure", BackoffMin: time.Second, BackoffMax: 30 * time.Second},
+		},
+		{
+			name: "no args",
+			spec: "web=perl",
+			want: childSpec{Name: "web", Cmd: "perl", Args: []string{}, Restart: "on-failure", BackoffMin: time.Second, BackoffMax: 30 * time.Second},
+		},
+		{
+			name: "restart and backoff",
+			spec: "web=perl,server.pl;restart=always;backoff=2s..1m",
+			want: childSpec{Name: "web", Cmd: "perl", Args: []string{"server.pl"}, Restart: "always", BackoffMin: 2 * time.Second, BackoffMax: time.Minute},
+		},
+		{
+			name: "restart never",
+			spec: "web=perl,server.pl;restart=never",
+			want: childSpec{Name: "web", Cmd: "perl", Args: []string{"server.pl"}, Restart: "never", BackoffMin: time.Second, BackoffMax: 30 * time.Second},
+		},
+		{
+			name:    "missing name",
+			spec:    "=perl,server.pl",
+			wantErr: true,
+		},
+		{
+			name:    "missing command",
+			spec:    "web=",
+			wantErr: true,
+		},
+		{
+			name:    "segment not key=value",
+			spec:    "web=perl,server.pl;oops",
+			wantErr: true,
+		},
+		{
+			name:    "unknown key",
+			spec:    "web=perl,server.pl;color=blue",
+			wantErr: true,
+		},
+		{
+			name:    "unknown restart value",
+			spec:    "web=perl,server.pl;restart=Always",
+			wantErr: true,
+		},
+		{
+			name:    "unknown restart value typo",
+			spec:    "web=perl,server.pl;restart=onfailure",
+			wantErr: true,
+		},
+		{
+			name:    "backoff missing max",
+			spec:    "web=perl,server.pl;backoff=1s",
+			wantErr: true,
+		},
+		{
+			name:    "backoff bad duration",
+			spec:    "web=perl,server.pl;backoff=1s..nope",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseChildSpec(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseChildSpec(%q) = %+v, want error", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseChildSpec(%q) returned unexpected error: %v", tt.spec, err)
+			}
+			if got.Name != tt.want.Name || got.Cmd != tt.want.Cmd || got.Restart != tt.want.Restart ||
+				got.BackoffMin != tt.want.BackoffMin || got.BackoffMax != tt.want.BackoffMax ||
+				len(got.Args) != len(tt.want.Args) {
+				t.Fatalf("parseChildSpec(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+			for i := range got.Args {
+				if got.Args[i] != tt.want.Args[i] {
+					t.Fatalf("parseChildSpec(%q) = %+v, want %+v", tt.spec, got, tt.want)
+				}
+			}
+		})
+	}
+}
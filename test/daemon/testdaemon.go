@@ -18,29 +18,109 @@ package main
 
 import (
 	"bufio"
-	"crypto/rand"
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var (
 	port    = flag.Int("port", 8000, "port")
 	crash   = flag.Bool("crash", false, "crash on start")
-	verbose = flag.Bool("verbose", false, "generate 512M of stderr and stdout then crash")
+	verbose = flag.Bool("verbose", false, "generate noise on stdout and stderr per the -noise-* flags, then crash once -noise-total bytes have been written")
+
+	unhealthyAfter = flag.Duration("unhealthy-after", 0, "if non-zero, /healthz starts returning 503 this long after start")
+	notReadyFor    = flag.Duration("not-ready-for", 0, "if non-zero, /readyz returns 429 for this long after start")
+	flapInterval   = flag.Duration("flap-interval", 0, "if non-zero, /healthz and /readyz alternate healthy/unhealthy every interval")
+
+	drain = flag.Duration("drain", 10*time.Second, "deadline for draining in-flight requests on graceful shutdown")
+
+	noiseRate    = flag.Int64("noise-rate", 0, "noise output rate in bytes/sec; 0 means unlimited")
+	noiseTotal   = flag.Int64("noise-total", 128<<20, "total bytes of noise to emit per run before stopping; 0 means run until /noise/stop")
+	noiseSeed    = flag.Uint64("noise-seed", 1, "seed for the noise PRNG; identical seeds produce byte-identical output")
+	noiseLineLen = flag.Int("noise-linelen", 64, "length in bytes of each noise line, hex-encoded pseudo-random data plus a newline")
+
+	startTime = time.Now()
+
+	srv   *http.Server
+	noise *noiseGen
+
+	requestCounter  uint64
+	machineIDPrefix = readMachineIDPrefix()
 )
 
+// readMachineIDPrefix returns the first 8 hex characters of /etc/machine-id,
+// falling back to "00000000" when it can't be read (e.g. non-Linux, or a
+// container without one mounted).
+func readMachineIDPrefix() string {
+	data, err := ioutil.ReadFile("/etc/machine-id")
+	if err != nil {
+		return "00000000"
+	}
+	id := strings.TrimSpace(string(data))
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return id
+}
+
+// responseRecorder wraps an http.ResponseWriter to capture the status code
+// and byte count written, for access logging.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	n, err := rr.ResponseWriter.Write(p)
+	rr.bytes += n
+	return n, err
+}
+
+// loggingMiddleware assigns each request a short correlation ID
+// (machine-id prefix + pid + an atomic counter), echoes it back in the
+// X-Request-Id header, and logs method/path/status/bytes/latency once the
+// handler completes.
+func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddUint64(&requestCounter, 1)
+		reqID := fmt.Sprintf("%s-%x-%x", machineIDPrefix, os.Getpid(), n)
+
+		w.Header().Set("X-Request-Id", reqID)
+		rr := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		start := time.Now()
+		next(rr, r)
+		latency := time.Since(start)
+
+		log.Printf("req %s %s %s status=%d bytes=%d latency=%s", reqID, r.Method, r.URL.Path, rr.status, rr.bytes, latency)
+	}
+}
+
 func crashHandler(w http.ResponseWriter, r *http.Request) {
 	status := 2
 	if st := r.FormValue("status"); st != "" {
@@ -50,7 +130,304 @@ func crashHandler(w http.ResponseWriter, r *http.Request) {
 	os.Exit(status)
 }
 
+// shutdown drains in-flight requests and stops supervised children, both
+// bounded by a single -drain deadline shared across the two phases, then
+// exits with status. It's safe to call from a signal handler or an HTTP
+// handler.
+func shutdown(status int) {
+	deadline := time.Now().Add(*drain)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+
+	remaining := time.Until(deadline)
+	if remaining < 0 {
+		remaining = 0
+	}
+	children.stopAll(remaining)
+	os.Exit(status)
+}
+
+// installSignalHandlers makes SIGTERM/SIGINT trigger the same graceful
+// drain-then-exit path as /quitquitquit.
+func installSignalHandlers() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		log.Printf("received signal %v, draining for up to %s", sig, *drain)
+		shutdown(0)
+	}()
+}
+
+// quitquitquitHandler implements the common "quitquitquit" convention: it
+// acknowledges immediately, then after the given delay stops accepting new
+// connections, drains in-flight ones (bounded by -drain), and exits with the
+// given status.
+func quitquitquitHandler(w http.ResponseWriter, r *http.Request) {
+	status := 0
+	if st := r.FormValue("status"); st != "" {
+		status, _ = strconv.Atoi(st)
+	}
+	after := time.Duration(0)
+	if a := r.FormValue("after"); a != "" {
+		if d, err := time.ParseDuration(a); err == nil {
+			after = d
+		}
+	}
+
+	fmt.Fprintf(w, "shutting down with status %d after %s\n", status, after)
+
+	go func() {
+		time.Sleep(after)
+		shutdown(status)
+	}()
+}
+
+// noiseStartHandler starts the background noise generator using the
+// process's -noise-* flags, if it isn't already running.
+func noiseStartHandler(w http.ResponseWriter, r *http.Request) {
+	noise.start(*noiseSeed, *noiseLineLen, *noiseRate, *noiseTotal, nil)
+	fmt.Fprintln(w, "started")
+}
+
+// noiseStopHandler halts the background noise generator, if running.
+func noiseStopHandler(w http.ResponseWriter, r *http.Request) {
+	noise.stop()
+	fmt.Fprintln(w, "stopped")
+}
+
+// noiseBurstHandler synchronously emits exactly ?bytes=N bytes of noise,
+// using -noise-seed and -noise-linelen, independent of the background
+// generator.
+func noiseBurstHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := strconv.ParseInt(r.FormValue("bytes"), 10, 64)
+	if err != nil || bytes <= 0 {
+		http.Error(w, "bytes must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	written := noise.burst(*noiseSeed, *noiseLineLen, bytes)
+	fmt.Fprintf(w, "wrote %d bytes\n", written)
+}
+
+// flapping reports whether -flap-interval puts us in the "down" half of the
+// current interval, i.e. toggling healthy/unhealthy on a fixed cadence.
+func flapping() bool {
+	if *flapInterval <= 0 {
+		return false
+	}
+	elapsed := time.Since(startTime)
+	return (elapsed/(*flapInterval))%2 == 1
+}
+
+// healthzHandler implements the liveness half of the healthz/readyz
+// protocol: 200 while healthy, 503 once -unhealthy-after has elapsed (or
+// while flapping down).
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	healthy := true
+	if *unhealthyAfter > 0 && time.Since(startTime) >= *unhealthyAfter {
+		healthy = false
+	}
+	if flapping() {
+		healthy = false
+	}
+	if !healthy {
+		http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler implements the readiness half: 429 while -not-ready-for
+// hasn't elapsed yet (or while flapping down), 200 otherwise.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready := true
+	if *notReadyFor > 0 && time.Since(startTime) < *notReadyFor {
+		ready = false
+	}
+	if flapping() {
+		ready = false
+	}
+	if !ready {
+		http.Error(w, "not ready", http.StatusTooManyRequests)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// status is the structured, machine-readable equivalent of the plain-text
+// output statusHandler has always produced.
+type status struct {
+	Pid       int               `json:"pid"`
+	Cwd       string            `json:"cwd"`
+	Uid       int               `json:"uid"`
+	Euid      int               `json:"euid"`
+	Gid       int               `json:"gid"`
+	Groups    []string          `json:"groups"`
+	Rlimits   map[string]rlimit `json:"rlimits"`
+	Env       map[string]string `json:"env"`
+	UptimeSec float64           `json:"uptime_sec"`
+	CPU       cpuStats          `json:"cpu"`
+	RSSBytes  int64             `json:"rss_bytes"`
+	Children  []int             `json:"children"`
+}
+
+type rlimit struct {
+	Cur int64 `json:"cur"`
+	Max int64 `json:"max"`
+}
+
+type cpuStats struct {
+	UserSec   float64 `json:"user_sec"`
+	SystemSec float64 `json:"system_sec"`
+}
+
+// wantsJSON reports whether r asked for the JSON status document, either via
+// the /status.json path or an Accept: application/json header.
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Path == "/status.json" {
+		return true
+	}
+	for _, accept := range r.Header["Accept"] {
+		if strings.Contains(accept, "application/json") {
+			return true
+		}
+	}
+	return false
+}
+
+func buildStatus() status {
+	cwd, _ := os.Getwd()
+	groups, _ := os.Getgroups()
+	groupNames := make([]string, len(groups))
+	for i, g := range groups {
+		groupNames[i] = strconv.Itoa(g)
+	}
+
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	rlimits := map[string]rlimit{}
+	for name, resource := range map[string]int{
+		// RLIMIT_NPROC has no portable constant in the standard syscall
+		// package (it'd need golang.org/x/sys/unix), so it's left out here.
+		"nofile": syscall.RLIMIT_NOFILE,
+		"as":     syscall.RLIMIT_AS,
+	} {
+		var rl syscall.Rlimit
+		if err := syscall.Getrlimit(resource, &rl); err == nil {
+			rlimits[name] = rlimit{Cur: int64(rl.Cur), Max: int64(rl.Max)}
+		}
+	}
+
+	cpu, rss := procStat()
+
+	return status{
+		Pid:       os.Getpid(),
+		Cwd:       cwd,
+		Uid:       os.Getuid(),
+		Euid:      os.Geteuid(),
+		Gid:       os.Getgid(),
+		Groups:    groupNames,
+		Rlimits:   rlimits,
+		Env:       env,
+		UptimeSec: time.Since(startTime).Seconds(),
+		CPU:       cpu,
+		RSSBytes:  rss,
+		Children:  childPIDs(),
+	}
+}
+
+// clockTicksPerSec is the value of sysconf(_SC_CLK_TCK) on every Linux
+// platform runsit targets; the /proc/[pid]/stat CPU fields are expressed in
+// these ticks.
+const clockTicksPerSec = 100
+
+// procStat parses /proc/self/stat and /proc/self/status for CPU time and
+// resident set size. Both are best-effort: on non-Linux systems or if the
+// files can't be read, zero values are returned.
+func procStat() (cpuStats, int64) {
+	var cpu cpuStats
+
+	if data, err := ioutil.ReadFile("/proc/self/stat"); err == nil {
+		// Process name may contain spaces/parens, so split after the last
+		// ')' rather than by field index.
+		if idx := strings.LastIndex(string(data), ")"); idx != -1 {
+			fields := strings.Fields(string(data)[idx+1:])
+			// utime is field 14, stime is field 15 overall; after the name
+			// they're fields 12 and 13 (0-indexed 11, 12).
+			if len(fields) > 12 {
+				utime, _ := strconv.ParseFloat(fields[11], 64)
+				stime, _ := strconv.ParseFloat(fields[12], 64)
+				cpu.UserSec = utime / clockTicksPerSec
+				cpu.SystemSec = stime / clockTicksPerSec
+			}
+		}
+	}
+
+	var rss int64
+	if data, err := ioutil.ReadFile("/proc/self/status"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "VmRSS:") {
+				fields := strings.Fields(line)
+				if len(fields) == 3 {
+					kb, _ := strconv.ParseInt(fields[1], 10, 64)
+					rss = kb * 1024
+				}
+			}
+		}
+	}
+
+	return cpu, rss
+}
+
+// childPIDs discovers direct children of this process by reading the
+// children file exposed under every thread's task directory, unioning and
+// deduplicating across threads since more than one may report the same pid.
+func childPIDs() []int {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[int]bool)
+	for _, task := range tasks {
+		data, err := ioutil.ReadFile(filepath.Join("/proc/self/task", task.Name(), "children"))
+		if err != nil {
+			continue
+		}
+		for _, f := range strings.Fields(string(data)) {
+			pid, err := strconv.Atoi(f)
+			if err == nil {
+				seen[pid] = true
+			}
+		}
+	}
+	pids := make([]int, 0, len(seen))
+	for pid := range seen {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
 func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(buildStatus()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintf(w, "pid=%d\n", os.Getpid())
 	cwd, _ := os.Getwd()
@@ -76,59 +453,129 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-type countWriter struct {
-	count int
+// noiseGen drives deterministic, rate-limited output to stdout and stderr.
+// Given the same seed, line length, and total, two separate runs produce
+// byte-identical streams.
+type noiseGen struct {
+	mu      sync.Mutex
+	running bool
+	stopCh  chan struct{}
 }
 
-func (cw *countWriter) Write(p []byte) (n int, err error) {
-	n = len(p)
-	cw.count += n
-	return
+func newNoiseGen() *noiseGen {
+	return &noiseGen{}
 }
 
-func logNoise(verbose bool) {
-	if verbose {
-		const (
-			buSize   = 16 << 10
-			maxBytes = 128 << 20
-		)
+// start begins emitting noise in a background goroutine at the given rate
+// (bytes/sec, 0 for unlimited) until total bytes have been written (0 for
+// unlimited) or stop is called. It's a no-op if noise is already running.
+// If onDone is non-nil, it's called once the run ends on its own (i.e. total
+// was reached); it's never called if the run is unbounded or is ended via
+// stop.
+func (n *noiseGen) start(seed uint64, lineLen int, rateBytesPerSec, total int64, onDone func()) {
+	n.mu.Lock()
+	if n.running {
+		n.mu.Unlock()
+		return
+	}
+	n.running = true
+	n.stopCh = make(chan struct{})
+	stopCh := n.stopCh
+	n.mu.Unlock()
 
-		buf := make([]byte, buSize)
-		_, err := io.ReadFull(rand.Reader, buf)
-		if err != nil {
-			log.Fatal("Failed to read random data:", err)
+	go func() {
+		rng := rand.New(rand.NewSource(int64(seed)))
+		bw1, bw2 := bufio.NewWriter(os.Stdout), bufio.NewWriter(os.Stderr)
+		written := writeNoise(io.MultiWriter(bw1, bw2), rng, lineLen, rateBytesPerSec, total, stopCh)
+		bw1.Flush()
+		bw2.Flush()
+
+		n.mu.Lock()
+		n.running = false
+		n.mu.Unlock()
+
+		if onDone != nil && total > 0 && written >= total {
+			onDone()
 		}
+	}()
+}
 
-		wg := new(sync.WaitGroup)
-		output := func(w io.Writer) {
-			cw := new(countWriter)
-			// Buffering stdio/stderr gives ~10x speedup.
-			w = bufio.NewWriter(w)
-			// Write to the passed in w and a countWriter so we can count how
-			// many bytes have been output.
-			w = io.MultiWriter(cw, w)
-			// Create some non-repeating multliline text output with sane
-			// line lengths.
-			w = hex.Dumper(w)
-			for cw.count < maxBytes {
-				_, err := w.Write(buf)
-				if err != nil {
-					log.Fatal("Failed to write random data:", err)
-				}
+// stop halts a running noise generator; it's a no-op if none is running.
+func (n *noiseGen) stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.running {
+		close(n.stopCh)
+		n.running = false
+	}
+}
+
+// burst synchronously writes exactly bytes bytes of noise to stdout and
+// stderr, independent of any running noise generator, and reports how many
+// bytes were actually written (always equal to bytes, barring a write
+// error).
+func (n *noiseGen) burst(seed uint64, lineLen int, bytes int64) int64 {
+	rng := rand.New(rand.NewSource(int64(seed)))
+	bw1, bw2 := bufio.NewWriter(os.Stdout), bufio.NewWriter(os.Stderr)
+	written := writeNoise(io.MultiWriter(bw1, bw2), rng, lineLen, 0, bytes, nil)
+	bw1.Flush()
+	bw2.Flush()
+	return written
+}
+
+// writeNoise writes hex-encoded pseudo-random lines of up to lineLen bytes
+// each (plus a trailing newline) to w, drawn from rng, until exactly total
+// bytes have been written (0 for unlimited) or stopCh is closed; the final
+// line is truncated as needed so the total is exact, not rounded up to a
+// line boundary. If rateBytesPerSec is non-zero, output is paced to that
+// rate. Callers are responsible for flushing w. Returns the number of bytes
+// written.
+func writeNoise(w io.Writer, rng *rand.Rand, lineLen int, rateBytesPerSec, total int64, stopCh <-chan struct{}) int64 {
+	if lineLen < 2 {
+		lineLen = 2
+	}
+	// raw holds enough random bytes to hex-encode at least lineLen
+	// characters, rounding up for odd lineLen so every hex digit in line is
+	// real encoded data rather than the zero value of an unfilled byte.
+	raw := make([]byte, (lineLen+1)/2)
+	hexed := make([]byte, len(raw)*2)
+	line := make([]byte, lineLen+1)
+	line[lineLen] = '\n'
+
+	var written int64
+	for total == 0 || written < total {
+		select {
+		case <-stopCh:
+			return written
+		default:
+		}
+
+		toWrite := len(line)
+		if total > 0 {
+			if remaining := total - written; remaining < int64(toWrite) {
+				toWrite = int(remaining)
 			}
-			wg.Done()
 		}
-		wg.Add(2)
-		go output(os.Stdout)
-		go output(os.Stderr)
-		wg.Wait()
-		os.Exit(1)
-	} else {
-		for {
-			log.Printf("some log noise")
-			time.Sleep(1 * time.Second)
+
+		start := time.Now()
+		rng.Read(raw)
+		hex.Encode(hexed, raw)
+		copy(line[:lineLen], hexed)
+		n, err := w.Write(line[:toWrite])
+		if err != nil {
+			log.Printf("Failed to write noise: %v", err)
+			return written
+		}
+		written += int64(n)
+
+		if rateBytesPerSec > 0 {
+			want := time.Duration(float64(n) / float64(rateBytesPerSec) * float64(time.Second))
+			if sleep := want - time.Since(start); sleep > 0 {
+				time.Sleep(sleep)
+			}
 		}
 	}
+	return written
 }
 
 func main() {
@@ -138,10 +585,7 @@ func main() {
 		log.Fatalf("fake crash on start")
 	}
 
-	cmd := exec.Command("/usr/bin/perl", "-e", `while(1) { print time(), "\n"; sleep 1; }`)
-	if err := cmd.Start(); err != nil {
-		log.Fatalf("error running child: %v", err)
-	}
+	children.start(childSpecsFlag)
 
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
@@ -150,13 +594,41 @@ func main() {
 
 	fmt.Fprintf(os.Stdout, "Hello on stdout; listening on port %d\n", *port)
 	fmt.Fprintf(os.Stderr, "Hello on stderr\n")
-	go logNoise(*verbose)
 
-	http.HandleFunc("/crash", crashHandler)
-	http.HandleFunc("/", statusHandler)
+	noise = newNoiseGen()
+	if *verbose {
+		// Matches the old one-shot burst's behavior of crashing once it's
+		// produced its configured volume of logs; exit(1) only fires when
+		// -noise-total is bounded, since an unbounded run never finishes.
+		noise.start(*noiseSeed, *noiseLineLen, *noiseRate, *noiseTotal, func() { os.Exit(1) })
+	} else {
+		go func() {
+			for {
+				log.Printf("some log noise")
+				time.Sleep(1 * time.Second)
+			}
+		}()
+	}
+
+	http.HandleFunc("/crash", loggingMiddleware(crashHandler))
+	http.HandleFunc("/status.json", loggingMiddleware(statusHandler))
+	http.HandleFunc("/healthz", loggingMiddleware(healthzHandler))
+	http.HandleFunc("/readyz", loggingMiddleware(readyzHandler))
+	http.HandleFunc("/quitquitquit", loggingMiddleware(quitquitquitHandler))
+	http.HandleFunc("/noise/start", loggingMiddleware(noiseStartHandler))
+	http.HandleFunc("/noise/stop", loggingMiddleware(noiseStopHandler))
+	http.HandleFunc("/noise/burst", loggingMiddleware(noiseBurstHandler))
+	http.HandleFunc("/children", loggingMiddleware(childrenListHandler))
+	http.HandleFunc("/children/", loggingMiddleware(childrenActionHandler))
+	http.HandleFunc("/", loggingMiddleware(statusHandler))
 
-	s := &http.Server{}
-	err = s.Serve(ln)
+	srv = &http.Server{}
+	installSignalHandlers()
+	err = srv.Serve(ln)
+	if err == http.ErrServerClosed {
+		log.Printf("Serve: drained and exiting")
+		return
+	}
 	log.Printf("Serve: %v", err)
 	if err != nil {
 		os.Exit(1)
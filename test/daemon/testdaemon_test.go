@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestWriteNoiseExactByteCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		lineLen int
+		total   int64
+	}{
+		{"even lineLen, multiple lines", 8, 100},
+		{"odd lineLen", 7, 100},
+		{"total shorter than one line", 8, 3},
+		{"total exactly one line", 9, 9},
+		{"lineLen below minimum", 1, 10},
+		{"zero total is unlimited", 8, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			rng := rand.New(rand.NewSource(1))
+			stopCh := make(chan struct{})
+			if tt.total == 0 {
+				close(stopCh)
+			}
+			written := writeNoise(&buf, rng, tt.lineLen, 0, tt.total, stopCh)
+			if tt.total != 0 && written != tt.total {
+				t.Fatalf("writeNoise(lineLen=%d, total=%d) wrote %d bytes, want %d", tt.lineLen, tt.total, written, tt.total)
+			}
+			if int64(buf.Len()) != written {
+				t.Fatalf("writeNoise(lineLen=%d, total=%d) reported %d bytes but buffer has %d", tt.lineLen, tt.total, written, buf.Len())
+			}
+		})
+	}
+}
+
+func TestWriteNoiseDeterministic(t *testing.T) {
+	run := func() string {
+		var buf bytes.Buffer
+		rng := rand.New(rand.NewSource(42))
+		writeNoise(&buf, rng, 16, 0, 200, nil)
+		return buf.String()
+	}
+	a, b := run(), run()
+	if a != b {
+		t.Fatalf("writeNoise with the same seed produced different output")
+	}
+}